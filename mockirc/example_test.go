@@ -2,41 +2,382 @@ package mockirc_test
 
 import (
 	"bufio"
-	"github.com/kyleterry/tenyks/mockirc"
-	"log"
+	"bytes"
+	"errors"
 	"net"
-)
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
-func ExampleIRCInteraction() {
-	var client net.Conn
-	var err error
-	var wait chan bool
+	"github.com/kyleterry/tenyks/mockirc"
+)
 
+func TestIRCInteraction(t *testing.T) {
 	ircServer := mockirc.New("mockirc.tenyks.io", 6661) // servername and port
 	// When I recieve "PING mockirc.tenyks.io" on the server, respond back with PONG...
 	ircServer.When("PING mockirc.tenyks.io").Respond(":PONG mockirc.tenyks.io")
 	ircServer.When("NICK kyle").Respond("... response to NICK")
-	wait, err = ircServer.Start()
+	wait, _, err := ircServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ircServer.Stop()
+	<-wait // wait for start to fire up channel
+
+	client, err := net.Dial("tcp", "localhost:6661")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io := bufio.NewReadWriter(
+		bufio.NewReader(client),
+		bufio.NewWriter(client))
+
+	if _, err := io.WriteString("PING mockirc.tenyks.io\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := io.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := io.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimRight(line, "\r\n"); got != ":PONG mockirc.tenyks.io" {
+		t.Fatalf("expected PONG response, got %q", got)
+	}
+}
+
+func TestIRCInteraction_transcript(t *testing.T) {
+	// A transcript captured once against a real network with Record can be
+	// replayed deterministically in CI with LoadTranscript.
+	transcript := strings.Join([]string{
+		"> PING mockirc.tenyks.io",
+		"< :PONG mockirc.tenyks.io",
+	}, "\n")
+
+	ircServer := mockirc.New("mockirc.tenyks.io", 6666) // servername and port
+	if err := ircServer.LoadTranscript(strings.NewReader(transcript)); err != nil {
+		t.Fatal(err)
+	}
+
+	var recorded bytes.Buffer
+	ircServer.Record(&recorded)
+
+	wait, _, err := ircServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ircServer.Stop()
+	<-wait // wait for start to fire up channel
+
+	client, err := net.Dial("tcp", "localhost:6666")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io := bufio.NewReadWriter(
+		bufio.NewReader(client),
+		bufio.NewWriter(client))
+
+	if _, err := io.WriteString("PING mockirc.tenyks.io\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := io.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := io.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimRight(line, "\r\n"); got != ":PONG mockirc.tenyks.io" {
+		t.Fatalf("expected PONG response, got %q", got)
+	}
+}
+
+func TestIRCInteraction_whenRegex(t *testing.T) {
+	ircServer := mockirc.New("mockirc.tenyks.io", 6662) // servername and port
+	// Capture group substitution lets one matcher handle any nickname.
+	ircServer.WhenRegex("^NICK (.+)$").Respond(":mockirc.tenyks.io 001 $1 :Welcome $1")
+	wait, _, err := ircServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ircServer.Stop()
+	<-wait // wait for start to fire up channel
+
+	client, err := net.Dial("tcp", "localhost:6662")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io := bufio.NewReadWriter(
+		bufio.NewReader(client),
+		bufio.NewWriter(client))
+
+	if _, err := io.WriteString("NICK kyle\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := io.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := io.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimRight(line, "\r\n"); got != ":mockirc.tenyks.io 001 kyle :Welcome kyle" {
+		t.Fatalf("expected welcome response, got %q", got)
+	}
+}
+
+func TestIRCInteraction_onCommand(t *testing.T) {
+	ircServer := mockirc.New("mockirc.tenyks.io", 6663) // servername and port
+	// OnCommand gives handlers access to the parsed message instead of the raw line.
+	ircServer.OnCommand("JOIN", func(s *mockirc.MockIRC, c *mockirc.ClientConn, m *mockirc.Message) {
+		c.Send(":kyle!kyle@mockirc.tenyks.io JOIN " + m.Params[0])
+	})
+	wait, _, err := ircServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ircServer.Stop()
+	<-wait // wait for start to fire up channel
+
+	client, err := net.Dial("tcp", "localhost:6663")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io := bufio.NewReadWriter(
+		bufio.NewReader(client),
+		bufio.NewWriter(client))
+
+	if _, err := io.WriteString("JOIN #tenyks\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := io.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := io.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimRight(line, "\r\n"); got != ":kyle!kyle@mockirc.tenyks.io JOIN #tenyks" {
+		t.Fatalf("expected JOIN echo, got %q", got)
+	}
+}
+
+func TestIRCInteraction_multiClient(t *testing.T) {
+	ircServer := mockirc.New("mockirc.tenyks.io", 6664) // servername and port
+	wait, _, err := ircServer.Start()
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	defer ircServer.Stop()
 	<-wait // wait for start to fire up channel
 
-	client, err = net.Dial("tcp", "localhost:6661")
+	kyle, err := net.Dial("tcp", "localhost:6664")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jake, err := net.Dial("tcp", "localhost:6664")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kyleIO := bufio.NewReadWriter(bufio.NewReader(kyle), bufio.NewWriter(kyle))
+	jakeIO := bufio.NewReadWriter(bufio.NewReader(jake), bufio.NewWriter(jake))
+
+	time.Sleep(50 * time.Millisecond) // let both connections register
+
+	if n := len(ircServer.Clients()); n != 2 {
+		t.Fatalf("expected two connected clients, got %d", n)
+	}
+
+	// Broadcast fans a line out to every tracked client, not just the last one.
+	ircServer.Broadcast(":mockirc.tenyks.io NOTICE * :server restarting soon")
+
+	for _, io := range []*bufio.ReadWriter{kyleIO, jakeIO} {
+		line, err := io.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimRight(line, "\r\n"); got != ":mockirc.tenyks.io NOTICE * :server restarting soon" {
+			t.Fatalf("expected broadcast notice, got %q", got)
+		}
+	}
+}
+
+func TestIRCInteraction_ircd(t *testing.T) {
+	ircServer := mockirc.New("mockirc.tenyks.io", 6665) // servername and port
+	// EnableIRCd scripts the registration handshake so tests don't have to.
+	ircServer.EnableIRCd(mockirc.IRCdOptions{
+		ISupport: []string{"CHANTYPES=#", "NETWORK=tenyks"},
+		Caps:     []string{"multi-prefix"},
+	})
+	wait, _, err := ircServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ircServer.Stop()
+	<-wait // wait for start to fire up channel
+
+	client, err := net.Dial("tcp", "localhost:6665")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	io := bufio.NewReadWriter(
 		bufio.NewReader(client),
 		bufio.NewWriter(client))
 
-	_, err = io.WriteString("PING mockirc.tenyks.io\r\n")
+	if _, err := io.WriteString("NICK kyle\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString("USER kyle 0 * :Kyle Terry\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := io.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := io.ReadString('\n')
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimRight(line, "\r\n"); got != ":mockirc.tenyks.io 001 kyle :Welcome to the Internet Relay Network kyle" {
+		t.Fatalf("expected welcome response, got %q", got)
 	}
+}
+
+// pipeAddr is a stand-in net.Addr for pipeListener.
+type pipeAddr struct{}
 
-	msg_string, err := io.ReadString('\n')
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeListener is a net.Listener backed by net.Pipe connections, for fully
+// in-process tests that don't want to bind a real TCP port.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
 
-	if msg_string != ":PONG mockirc.tenyks.io" {
-		log.Fatal("Invalid response")
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn, 4), closed: make(chan struct{})}
+}
+
+func (p *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.closed:
+		return nil, errors.New("pipeListener: closed")
+	}
+}
+
+func (p *pipeListener) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return nil
+}
+
+func (p *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func TestIRCInteraction_inMemoryListener(t *testing.T) {
+	listener := newPipeListener()
+	client, server := net.Pipe()
+	listener.conns <- server
+
+	ircServer := mockirc.NewWithListener("mockirc.tenyks.io", listener)
+	ircServer.When("PING mockirc.tenyks.io").Respond(":PONG mockirc.tenyks.io")
+	wait, _, err := ircServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ircServer.Stop()
+	<-wait // wait for start to fire up channel
+
+	io := bufio.NewReadWriter(
+		bufio.NewReader(client),
+		bufio.NewWriter(client))
+
+	if _, err := io.WriteString("PING mockirc.tenyks.io\r\n"); err != nil {
+		t.Fatal(err)
 	}
+	if err := io.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := io.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimRight(line, "\r\n"); got != ":PONG mockirc.tenyks.io" {
+		t.Fatalf("expected PONG response, got %q", got)
+	}
+}
+
+// TestIRCInteraction_inMemoryListener_multiClient guards against the two
+// net.Pipe connections (which both report the constant address "pipe")
+// colliding in the client registry and being tracked as a single client.
+func TestIRCInteraction_inMemoryListener_multiClient(t *testing.T) {
+	listener := newPipeListener()
+	kyle, kyleServer := net.Pipe()
+	jake, jakeServer := net.Pipe()
+	listener.conns <- kyleServer
+	listener.conns <- jakeServer
+
+	ircServer := mockirc.NewWithListener("mockirc.tenyks.io", listener)
+	wait, _, err := ircServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ircServer.Stop()
+	<-wait // wait for start to fire up channel
+
+	kyleIO := bufio.NewReadWriter(bufio.NewReader(kyle), bufio.NewWriter(kyle))
+	jakeIO := bufio.NewReadWriter(bufio.NewReader(jake), bufio.NewWriter(jake))
+
+	time.Sleep(50 * time.Millisecond) // let both connections register
+
+	if n := len(ircServer.Clients()); n != 2 {
+		t.Fatalf("expected two connected clients, got %d", n)
+	}
+
+	// Unlike a real TCP socket, net.Pipe has no buffer: a write blocks until
+	// its peer reads. Broadcast writes to each client in turn, so both
+	// clients must be reading concurrently with it, not after it returns.
+	var wg sync.WaitGroup
+	for _, io := range []*bufio.ReadWriter{kyleIO, jakeIO} {
+		wg.Add(1)
+		go func(io *bufio.ReadWriter) {
+			defer wg.Done()
+			line, err := io.ReadString('\n')
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := strings.TrimRight(line, "\r\n"); got != ":mockirc.tenyks.io NOTICE * :server restarting soon" {
+				t.Errorf("expected broadcast notice, got %q", got)
+			}
+		}(io)
+	}
+
+	ircServer.Broadcast(":mockirc.tenyks.io NOTICE * :server restarting soon")
+	wg.Wait()
 }
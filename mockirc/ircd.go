@@ -0,0 +1,247 @@
+package mockirc
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 10 * time.Second
+	isupportChunkSize   = 13
+)
+
+// IRCdOptions configures the behavior installed by EnableIRCd.
+type IRCdOptions struct {
+	// ISupport is the list of ISUPPORT (005) tokens advertised to clients on
+	// registration, e.g. []string{"CHANTYPES=#", "NETWORK=tenyks", "PREFIX=(ov)@+"}.
+	ISupport []string
+
+	// Caps is the list of capabilities advertised in response to CAP LS, in
+	// either bare ("multi-prefix") or key=value ("sasl=PLAIN") form.
+	Caps []string
+
+	// PingInterval is how often PING is sent to each registered client.
+	// Defaults to 30s when zero.
+	PingInterval time.Duration
+
+	// PongTimeout is how long to wait for a PONG before treating the
+	// connection as stoned and disconnecting it. Defaults to 10s when zero.
+	PongTimeout time.Duration
+}
+
+// ircdState holds the parsed, ready-to-serve form of an IRCdOptions.
+type ircdState struct {
+	opts          IRCdOptions
+	capsSupported map[string]string
+}
+
+// parseTokens splits a list of ISUPPORT/CAP-style tokens into a map, the way
+// mainstream Go IRC libraries do: "KEY=VALUE" tokens map to their value,
+// bare tokens map to the empty string.
+func parseTokens(tokens []string) map[string]string {
+	parsed := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		if idx := strings.Index(token, "="); idx >= 0 {
+			parsed[token[:idx]] = token[idx+1:]
+		} else {
+			parsed[token] = ""
+		}
+	}
+	return parsed
+}
+
+// EnableIRCd installs default handlers that emulate a real ircd's connection
+// registration flow (NICK/USER -> 001-005), CAP LS/REQ/END negotiation, PING
+// keepalive with stoned-server detection, and JOIN -> 353/366 name-list
+// replies. It turns MockIRC from a raw request/response matcher into a
+// realistic fixture for testing against a plausible server without every
+// test re-scripting the handshake.
+func (irc *MockIRC) EnableIRCd(opts IRCdOptions) {
+	if opts.PingInterval == 0 {
+		opts.PingInterval = defaultPingInterval
+	}
+	if opts.PongTimeout == 0 {
+		opts.PongTimeout = defaultPongTimeout
+	}
+	irc.ircd = &ircdState{
+		opts:          opts,
+		capsSupported: parseTokens(opts.Caps),
+	}
+
+	irc.OnCommand("NICK", ircdNick)
+	irc.OnCommand("USER", ircdUser)
+	irc.OnCommand("CAP", ircdCap)
+	irc.OnCommand("PING", ircdClientPing)
+	irc.OnCommand("PONG", ircdPong)
+	irc.OnCommand("JOIN", ircdJoin)
+}
+
+func ircdNick(irc *MockIRC, client *ClientConn, msg *Message) {
+	if len(msg.Params) > 0 {
+		client.Nick = msg.Params[0]
+	}
+	irc.maybeWelcome(client)
+}
+
+func ircdUser(irc *MockIRC, client *ClientConn, msg *Message) {
+	if len(msg.Params) > 0 {
+		client.User = msg.Params[0]
+	}
+	irc.maybeWelcome(client)
+}
+
+// maybeWelcome sends the 001-004 registration burst and the ISUPPORT (005)
+// lines once a client has sent both NICK and USER, then starts its PING
+// keepalive loop.
+func (irc *MockIRC) maybeWelcome(client *ClientConn) {
+	if client.Registered || client.Nick == "" || client.User == "" {
+		return
+	}
+	client.Registered = true
+
+	client.Send(fmt.Sprintf(":%s 001 %s :Welcome to the Internet Relay Network %s", irc.ServerName, client.Nick, client.Nick))
+	client.Send(fmt.Sprintf(":%s 002 %s :Your host is %s, running mockirc", irc.ServerName, client.Nick, irc.ServerName))
+	client.Send(fmt.Sprintf(":%s 003 %s :This server was created just now", irc.ServerName, client.Nick))
+	client.Send(fmt.Sprintf(":%s 004 %s %s mockirc-0 o o", irc.ServerName, client.Nick, irc.ServerName))
+	irc.sendISupport(client)
+
+	irc.wg.Add(1)
+	go func() {
+		defer irc.wg.Done()
+		irc.pingLoop(client)
+	}()
+}
+
+// sendISupport writes the configured ISUPPORT tokens as one or more 005
+// lines, chunked the way real ircds do to stay under typical line-length
+// limits.
+func (irc *MockIRC) sendISupport(client *ClientConn) {
+	tokens := irc.ircd.opts.ISupport
+	for i := 0; i < len(tokens); i += isupportChunkSize {
+		end := i + isupportChunkSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		client.Send(fmt.Sprintf(":%s 005 %s %s :are supported by this server",
+			irc.ServerName, client.Nick, strings.Join(tokens[i:end], " ")))
+	}
+}
+
+// ircdCap handles CAP LS/REQ/END negotiation.
+func ircdCap(irc *MockIRC, client *ClientConn, msg *Message) {
+	if len(msg.Params) == 0 {
+		return
+	}
+	nick := client.Nick
+	if nick == "" {
+		nick = "*"
+	}
+
+	switch strings.ToUpper(msg.Params[0]) {
+	case "LS":
+		caps := make([]string, 0, len(irc.ircd.capsSupported))
+		for name, value := range irc.ircd.capsSupported {
+			if value == "" {
+				caps = append(caps, name)
+			} else {
+				caps = append(caps, name+"="+value)
+			}
+		}
+		sort.Strings(caps)
+		client.Send(fmt.Sprintf(":%s CAP %s LS :%s", irc.ServerName, nick, strings.Join(caps, " ")))
+	case "REQ":
+		requested := msg.Trailing
+		if requested == "" && len(msg.Params) > 1 {
+			requested = strings.Join(msg.Params[1:], " ")
+		}
+		var acked []string
+		for _, token := range strings.Fields(requested) {
+			if _, ok := irc.ircd.capsSupported[strings.TrimPrefix(token, "-")]; ok {
+				acked = append(acked, token)
+				client.Caps[strings.TrimPrefix(token, "-")] = !strings.HasPrefix(token, "-")
+			}
+		}
+		client.Send(fmt.Sprintf(":%s CAP %s ACK :%s", irc.ServerName, nick, strings.Join(acked, " ")))
+	case "END":
+		// Negotiation finished; nothing to acknowledge.
+	}
+}
+
+// ircdJoin sends the JOIN echo followed by the 353/366 name-list replies.
+func ircdJoin(irc *MockIRC, client *ClientConn, msg *Message) {
+	if len(msg.Params) == 0 {
+		return
+	}
+	channel := msg.Params[0]
+	client.Channels[channel] = true
+
+	client.Send(fmt.Sprintf(":%s!%s@%s JOIN %s", client.Nick, client.User, irc.ServerName, channel))
+	client.Send(fmt.Sprintf(":%s 353 %s = %s :%s", irc.ServerName, client.Nick, channel, strings.Join(irc.channelNicks(channel), " ")))
+	client.Send(fmt.Sprintf(":%s 366 %s %s :End of /NAMES list.", irc.ServerName, client.Nick, channel))
+}
+
+// channelNicks returns the nicks of every connected client that has joined channel.
+func (irc *MockIRC) channelNicks(channel string) []string {
+	var nicks []string
+	for _, client := range irc.Clients() {
+		if client.Channels[channel] {
+			nicks = append(nicks, client.Nick)
+		}
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// ircdClientPing answers a client-initiated PING with the matching PONG.
+func ircdClientPing(irc *MockIRC, client *ClientConn, msg *Message) {
+	token := irc.ServerName
+	if len(msg.Params) > 0 {
+		token = msg.Params[0]
+	}
+	client.Send(fmt.Sprintf(":%s PONG %s :%s", irc.ServerName, irc.ServerName, token))
+}
+
+// ircdPong records that client answered our keepalive PING.
+func ircdPong(_ *MockIRC, client *ClientConn, _ *Message) {
+	select {
+	case client.pong <- struct{}{}:
+	default:
+	}
+}
+
+// pingLoop sends a PING to client every PingInterval and disconnects it if no
+// PONG arrives within PongTimeout, emulating a real server's stoned-client
+// detection. Runs in its own goroutine until the client disconnects or the
+// server stops.
+func (irc *MockIRC) pingLoop(client *ClientConn) {
+	ticker := time.NewTicker(irc.ircd.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-irc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		client.Send(fmt.Sprintf(":%s PING :%s", irc.ServerName, irc.ServerName))
+
+		select {
+		case <-client.pong:
+		case <-time.After(irc.ircd.opts.PongTimeout):
+			log.Printf("client %s looks stoned, no PONG received; disconnecting\n", client.RemoteAddr)
+			client.Conn.Close()
+			return
+		case <-client.done:
+			return
+		case <-irc.ctx.Done():
+			return
+		}
+	}
+}
@@ -2,21 +2,37 @@ package mockirc
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
+// stopGraceTimeout is how long Stop waits for in-flight goroutines to exit on
+// their own before force-closing client connections.
+const stopGraceTimeout = time.Second
+
 type MockIRC struct {
 	Port       int
 	ServerName string
 	Socket     net.Listener
 	events     map[string]*WhenEvent
-	io         *bufio.ReadWriter
-	stop       bool
+	matchers   []*WhenEvent
+	handlers   map[string]func(*MockIRC, *ClientConn, *Message)
+	clients    sync.Map // *ClientConn -> struct{}
+	ircd       *ircdState
+	tlsConfig  *tls.Config
+	recorder   io.Writer
+	recorderMu sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
 }
 
 // New will create a new instance of mockirc.
@@ -30,110 +46,194 @@ func New(server string, port int) *MockIRC {
 	}
 	irc.ServerName = server
 	irc.events = make(map[string]*WhenEvent)
+	irc.handlers = make(map[string]func(*MockIRC, *ClientConn, *Message))
+	irc.ctx, irc.cancel = context.WithCancel(context.Background())
+	return irc
+}
+
+// stopped reports whether the server's context has been cancelled by Stop.
+func (irc *MockIRC) stopped() bool {
+	select {
+	case <-irc.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// NewTLS will create a new instance of mockirc that serves connections over
+// TLS using cert, the way a real IRC network's +6697 port would. It's useful
+// for exercising a client's TLS connection path against a self-signed cert.
+// Returns a pointer to a MockIRC struct.
+func NewTLS(server string, port int, cert tls.Certificate) *MockIRC {
+	irc := New(server, port)
+	irc.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return irc
+}
+
+// NewWithListener will create a new instance of mockirc that serves
+// connections on the already-constructed listener l instead of binding its
+// own TCP port. This is useful in tests that plug in a net.Pipe-backed
+// listener to run fully in-process without a real socket.
+// Returns a pointer to a MockIRC struct.
+func NewWithListener(server string, l net.Listener) *MockIRC {
+	irc := New(server, 0)
+	irc.Socket = l
 	return irc
 }
 
-// Start will start the "irc" server and listen on the port passed to New.
-// Returns a channel of type bool or an error.
-func (irc *MockIRC) Start() (chan bool, error) {
+// Start will start the "irc" server. If a listener wasn't already supplied via
+// NewWithListener, it binds the port passed to New, wrapping it in TLS first
+// if the instance was created with NewTLS.
+// Returns a channel of type bool that fires once the server is ready to
+// accept connections, a channel of asynchronous listener errors, and any
+// error from the initial net.Listen.
+func (irc *MockIRC) Start() (chan bool, <-chan error, error) {
 	wait := make(chan bool, 1)
-	sock, err := net.Listen("tcp", fmt.Sprintf(":%d", irc.Port))
-	if err != nil {
-		return nil, err
+	errs := make(chan error, 1)
+	if irc.Socket == nil {
+		sock, err := net.Listen("tcp", fmt.Sprintf(":%d", irc.Port))
+		if err != nil {
+			return nil, nil, err
+		}
+		if irc.tlsConfig != nil {
+			sock = tls.NewListener(sock, irc.tlsConfig)
+		}
+		irc.Socket = sock
 	}
-	irc.Socket = sock
-	go func() {
-		defer close(wait)
-
-		accept := func() <-chan net.Conn {
-			a := make(chan net.Conn)
-			go func() {
-				for {
-					conn, err := irc.Socket.Accept()
-					if err != nil {
-						if irc.stop {
-							return
-						}
-						log.Println(err)
-						continue
-					}
-					if conn != nil {
-						a <- conn
-					}
-				}
-			}()
-			return a
-		}()
 
-		wait <- true
+	irc.wg.Add(1)
+	go irc.acceptLoop(wait, errs)
+
+	return wait, errs, nil
+}
+
+// acceptLoop accepts incoming connections until the server is stopped,
+// spawning a tracked connectionWorker goroutine for each one and forwarding
+// any non-fatal Accept errors on errs.
+func (irc *MockIRC) acceptLoop(wait chan bool, errs chan<- error) {
+	defer irc.wg.Done()
+	defer close(wait)
+
+	wait <- true
 
-		for {
-			conn := <-accept
-			if irc.stop {
+	for {
+		conn, err := irc.Socket.Accept()
+		if err != nil {
+			if irc.stopped() {
 				return
 			}
-			go irc.connectionWorker(conn)
+			select {
+			case errs <- err:
+			default:
+			}
+			log.Println(err)
+			continue
 		}
-	}()
-	return wait, nil
+		if conn == nil {
+			continue
+		}
+		irc.wg.Add(1)
+		go func() {
+			defer irc.wg.Done()
+			irc.connectionWorker(conn)
+		}()
+	}
 }
 
-// Stop will send the shutdown message on the control channel and stop the server.
-// It could return an error.
+// Stop cancels the server and closes the listener, waits up to
+// stopGraceTimeout for in-flight goroutines to exit on their own, then
+// force-closes any still-open client connections.
+// Returns any error from closing the listener.
 func (irc *MockIRC) Stop() error {
-	if irc.stop {
+	return irc.stopWithQuit("")
+}
+
+// StopWithQuit behaves like Stop, but first broadcasts quit to every
+// connected client so it sees a graceful disconnect message instead of an
+// abrupt EOF.
+func (irc *MockIRC) StopWithQuit(quit string) error {
+	return irc.stopWithQuit(quit)
+}
+
+func (irc *MockIRC) stopWithQuit(quit string) error {
+	if irc.stopped() {
 		return nil
 	}
+	if quit != "" {
+		irc.Broadcast(quit)
+	}
+	irc.cancel()
 
-	irc.stop = true
 	err := irc.Socket.Close()
-	if err != nil {
-		return err
+
+	done := make(chan struct{})
+	go func() {
+		irc.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(stopGraceTimeout):
+		for _, client := range irc.Clients() {
+			client.Conn.Close()
+		}
+		<-done
 	}
-	<-time.After(time.Second)
-	return nil
+
+	return err
 }
 
 // connectionWorker will handle incoming connections from Accept.
 // Runs in it's own goroutine.
 func (irc *MockIRC) connectionWorker(conn net.Conn) {
-	irc.io = bufio.NewReadWriter(
-		bufio.NewReader(conn),
-		bufio.NewWriter(conn))
+	client := &ClientConn{
+		Conn:       conn,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Channels:   make(map[string]bool),
+		Caps:       make(map[string]bool),
+		io: bufio.NewReadWriter(
+			bufio.NewReader(conn),
+			bufio.NewWriter(conn)),
+		pong: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		irc:  irc,
+	}
+	irc.clients.Store(client, struct{}{})
+	defer irc.clients.Delete(client)
+	defer close(client.done)
 	defer conn.Close()
 	for {
-		msg, err := irc.io.ReadString('\n')
+		msg, err := client.io.ReadString('\n')
 		if err != nil {
-			if !irc.stop {
+			if !irc.stopped() {
 				if err == io.EOF {
 					log.Println(err)
 				}
 			}
 			return
 		}
-		irc.handleMessage(msg)
+		irc.handleMessage(client, msg)
 	}
 }
 
-// handleMessage will figure out how to handle messages coming in. It looks at the
-// events map to see if it matched anything to send a response.
-func (irc *MockIRC) handleMessage(msg string) {
-	if !irc.stop {
+// handleMessage will figure out how to handle messages coming in from client. It
+// parses the line into a Message and dispatches to a command handler registered
+// with OnCommand first. Failing that, it checks the events map for an exact
+// match, then falls back to the ordered list of regex matchers registered
+// through WhenRegex.
+func (irc *MockIRC) handleMessage(client *ClientConn, msg string) {
+	if !irc.stopped() {
 		msg = strings.TrimSuffix(msg, "\r\n")
-		var err error
-		if val, ok := irc.events[msg]; ok {
-			for _, response := range val.responses {
-				_, err = irc.io.WriteString(response + "\r\n")
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				err = irc.io.Flush()
-				if err != nil {
-					log.Println(err)
-					return
-				}
-			}
+		irc.recordLine('>', msg)
+		parsed := ParseMessage(msg)
+		if handler, ok := irc.handlers[parsed.Command]; ok {
+			handler(irc, client, parsed)
+		} else if val, ok := irc.events[msg]; ok {
+			irc.sendResponses(client, val.responses)
+		} else if val, groups := irc.matchRegex(msg); val != nil {
+			irc.sendResponses(client, substituteGroups(val.responses, groups))
 		} else {
 			log.Printf("Nothing to do for %s\n", msg)
 		}
@@ -141,16 +241,173 @@ func (irc *MockIRC) handleMessage(msg string) {
 	}
 }
 
-// Send will write the string to the connection.
-func (irc *MockIRC) Send(thing string) {
-	if !irc.stop {
-		irc.io.WriteString(thing + "\r\n")
+// OnCommand registers a handler that is invoked whenever a parsed message's
+// Command matches cmd, taking precedence over both When and WhenRegex. The
+// handler receives the ClientConn the message came in on, so it can reply to
+// that client specifically or fan a response out to others via Broadcast.
+// Example use: `srv.OnCommand("JOIN", func(s *mockirc.MockIRC, c *mockirc.ClientConn, m *mockirc.Message) {
+//     c.Send(":kyle!kyle@host JOIN " + m.Params[0])
+// })`
+func (irc *MockIRC) OnCommand(cmd string, handler func(*MockIRC, *ClientConn, *Message)) {
+	irc.handlers[cmd] = handler
+}
+
+// matchRegex walks the ordered list of regex matchers looking for the first
+// one whose pattern matches msg. Returns the matching WhenEvent and its
+// submatches, or a nil WhenEvent if nothing matched.
+func (irc *MockIRC) matchRegex(msg string) (*WhenEvent, []string) {
+	for _, when := range irc.matchers {
+		if when.pattern == nil {
+			continue
+		}
+		if groups := when.pattern.FindStringSubmatch(msg); groups != nil {
+			return when, groups
+		}
+	}
+	return nil, nil
+}
+
+// substituteGroups replaces $1, $2, etc in each response template with the
+// corresponding capture group from groups (groups[0] is the full match).
+func substituteGroups(responses []string, groups []string) []string {
+	substituted := make([]string, len(responses))
+	for i, response := range responses {
+		for n := len(groups) - 1; n >= 1; n-- {
+			response = strings.ReplaceAll(response, fmt.Sprintf("$%d", n), groups[n])
+		}
+		substituted[i] = response
+	}
+	return substituted
+}
+
+// sendResponses writes each response to client's connection in order.
+func (irc *MockIRC) sendResponses(client *ClientConn, responses []string) {
+	for _, response := range responses {
+		client.Send(response)
 	}
 }
 
+// recordLine appends a line to the transcript writer set by Record, if any.
+// direction is '>' for a line received from a client and '<' for a line sent
+// to one, matching the format read back by LoadTranscript.
+func (irc *MockIRC) recordLine(direction byte, content string) {
+	if irc.recorder == nil {
+		return
+	}
+	irc.recorderMu.Lock()
+	defer irc.recorderMu.Unlock()
+	fmt.Fprintf(irc.recorder, "%c %s\n", direction, content)
+}
+
+// Record writes every line received from or sent to clients to w, formatted
+// the same way LoadTranscript expects to read them back, for the lifetime of
+// the server (or until Record is called again with a different writer).
+func (irc *MockIRC) Record(w io.Writer) {
+	irc.recorder = w
+}
+
+// Clients returns the set of currently connected clients.
+func (irc *MockIRC) Clients() []*ClientConn {
+	var clients []*ClientConn
+	irc.clients.Range(func(k, _ interface{}) bool {
+		clients = append(clients, k.(*ClientConn))
+		return true
+	})
+	return clients
+}
+
+// Broadcast sends line to every currently connected client.
+func (irc *MockIRC) Broadcast(line string) {
+	for _, client := range irc.Clients() {
+		client.Send(line)
+	}
+}
+
+// ClientConn tracks the per-connection state of a single client socket:
+// its own reader/writer, nickname, joined channels, and remote address.
+type ClientConn struct {
+	Conn       net.Conn
+	RemoteAddr string
+	Nick       string
+	User       string
+	Registered bool
+	Channels   map[string]bool
+	Caps       map[string]bool
+	io         *bufio.ReadWriter
+	writeMu    sync.Mutex
+	pong       chan struct{}
+	done       chan struct{}
+	irc        *MockIRC
+}
+
+// Send will write the string to this client's connection. Safe to call
+// concurrently: Broadcast, handler-driven replies, and the IRCd ping
+// keepalive may all write to the same client at once, so the write side of
+// the bufio.ReadWriter is guarded by writeMu (the reader in
+// connectionWorker is unaffected, since bufio's reader and writer are
+// independent).
+func (c *ClientConn) Send(line string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.io.WriteString(line + "\r\n"); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := c.io.Flush(); err != nil {
+		log.Println(err)
+		return
+	}
+	c.irc.recordLine('<', line)
+}
+
+// Message represents a single IRC line as parsed per RFC 1459/2812:
+// `[:prefix] command param0 param1 ... [:trailing]`.
+type Message struct {
+	Prefix   string
+	Command  string
+	Params   []string
+	Trailing string
+}
+
+// ParseMessage parses a raw IRC line (with or without a trailing \r\n) into a
+// Message. It does not validate the command or parameter count; malformed
+// input simply yields an empty Command and/or Params.
+func ParseMessage(line string) *Message {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	msg := &Message{}
+
+	if strings.HasPrefix(line, ":") {
+		parts := strings.SplitN(line, " ", 2)
+		msg.Prefix = strings.TrimPrefix(parts[0], ":")
+		if len(parts) < 2 {
+			return msg
+		}
+		line = parts[1]
+	}
+
+	hasTrailing := false
+	if idx := strings.Index(line, " :"); idx >= 0 {
+		hasTrailing = true
+		msg.Trailing = line[idx+2:]
+		line = line[:idx]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return msg
+	}
+	msg.Command = fields[0]
+	msg.Params = fields[1:]
+	if hasTrailing {
+		msg.Params = append(msg.Params, msg.Trailing)
+	}
+	return msg
+}
+
 type WhenEvent struct {
 	event     string
 	responses []string
+	pattern   *regexp.Regexp
 }
 
 // When will take a string that represents an event. This stores the event in a map
@@ -163,6 +420,24 @@ func (irc *MockIRC) When(event string) *WhenEvent {
 	return when
 }
 
+// WhenRegex takes a regular expression and registers it as a matcher that is
+// checked, in registration order, whenever an incoming message doesn't match
+// one of the literal events registered with When. Capture groups from the
+// pattern can be substituted into responses with $1, $2, etc.
+// Example use: `mockircserver.WhenRegex("^NICK (.+)$").Respond(":mockirc 001 $1 :welcome $1")
+// Returns the new WhenEvent instance for method chaining.
+func (irc *MockIRC) WhenRegex(pattern string) *WhenEvent {
+	when := &WhenEvent{event: pattern}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Println(err)
+		return when
+	}
+	when.pattern = re
+	irc.matchers = append(irc.matchers, when)
+	return when
+}
+
 // This will add to a list of reponses to send back when an event is matched.
 // Returns the new WhenEvent instance for method chaining.
 func (when *WhenEvent) Respond(response string) *WhenEvent {
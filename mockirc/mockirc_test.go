@@ -0,0 +1,63 @@
+package mockirc
+
+import "testing"
+
+func TestParseMessage(t *testing.T) {
+	cases := []struct {
+		line     string
+		prefix   string
+		command  string
+		params   []string
+		trailing string
+	}{
+		{
+			line:    "NICK kyle",
+			command: "NICK",
+			params:  []string{"kyle"},
+		},
+		{
+			line:    "JOIN #tenyks",
+			command: "JOIN",
+			params:  []string{"#tenyks"},
+		},
+		{
+			line:     ":kyle!kyle@host PRIVMSG #tenyks :hello there friend",
+			prefix:   "kyle!kyle@host",
+			command:  "PRIVMSG",
+			params:   []string{"#tenyks", "hello there friend"},
+			trailing: "hello there friend",
+		},
+		{
+			line:    ":mockirc.tenyks.io PING",
+			prefix:  "mockirc.tenyks.io",
+			command: "PING",
+		},
+		{
+			line:     "PRIVMSG #tenyks :",
+			command:  "PRIVMSG",
+			params:   []string{"#tenyks", ""},
+			trailing: "",
+		},
+	}
+
+	for _, c := range cases {
+		msg := ParseMessage(c.line)
+		if msg.Prefix != c.prefix {
+			t.Errorf("%q: expected prefix %q, got %q", c.line, c.prefix, msg.Prefix)
+		}
+		if msg.Command != c.command {
+			t.Errorf("%q: expected command %q, got %q", c.line, c.command, msg.Command)
+		}
+		if msg.Trailing != c.trailing {
+			t.Errorf("%q: expected trailing %q, got %q", c.line, c.trailing, msg.Trailing)
+		}
+		if len(msg.Params) != len(c.params) {
+			t.Fatalf("%q: expected params %v, got %v", c.line, c.params, msg.Params)
+		}
+		for i, p := range c.params {
+			if msg.Params[i] != p {
+				t.Errorf("%q: expected param %d to be %q, got %q", c.line, i, p, msg.Params[i])
+			}
+		}
+	}
+}
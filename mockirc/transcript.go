@@ -0,0 +1,67 @@
+package mockirc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LoadTranscript reads a plaintext IRC session log from r and auto-registers
+// When(clientLine).Respond(serverLine...) pairs from it, in order. Lines are
+// expected to be prefixed with "> " for a line sent by the client or "< " for
+// a line sent back by the server, optionally preceded by a whitespace-free
+// timestamp token (e.g. "15:04:05 > NICK kyle"). Every "< " line is attached
+// as a response to the most recently seen "> " line, so a single client line
+// can be followed by several server lines. Lines that don't match either
+// prefix are ignored. This is the inverse of Record, letting a session
+// captured once against a real network be replayed deterministically in CI.
+func (irc *MockIRC) LoadTranscript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var when *WhenEvent
+	for scanner.Scan() {
+		direction, content, ok := splitTranscriptLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		switch direction {
+		case '>':
+			when = irc.When(content)
+		case '<':
+			if when == nil {
+				return fmt.Errorf("mockirc: transcript has a server line %q before any client line", content)
+			}
+			when.Respond(content)
+		}
+	}
+	return scanner.Err()
+}
+
+// splitTranscriptLine splits a transcript line into its direction ('<' or
+// '>') and content, skipping an optional leading timestamp token. ok is false
+// if line doesn't contain a recognized direction marker.
+func splitTranscriptLine(line string) (direction byte, content string, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return 0, "", false
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) == 2 && isDirectionMarker(fields[0]) {
+		return fields[0][0], fields[1], true
+	}
+
+	// Try again, skipping a single leading timestamp token.
+	if len(fields) == 2 {
+		rest := strings.SplitN(fields[1], " ", 2)
+		if len(rest) == 2 && isDirectionMarker(rest[0]) {
+			return rest[0][0], rest[1], true
+		}
+	}
+
+	return 0, "", false
+}
+
+func isDirectionMarker(token string) bool {
+	return token == "<" || token == ">"
+}
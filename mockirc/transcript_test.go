@@ -0,0 +1,67 @@
+package mockirc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitTranscriptLine(t *testing.T) {
+	cases := []struct {
+		line      string
+		direction byte
+		content   string
+		ok        bool
+	}{
+		{line: "> NICK kyle", direction: '>', content: "NICK kyle", ok: true},
+		{line: "< :mockirc.tenyks.io 001 kyle :Welcome", direction: '<', content: ":mockirc.tenyks.io 001 kyle :Welcome", ok: true},
+		{line: "15:04:05 > NICK kyle", direction: '>', content: "NICK kyle", ok: true},
+		{line: "not a transcript line", ok: false},
+		{line: "", ok: false},
+	}
+
+	for _, c := range cases {
+		direction, content, ok := splitTranscriptLine(c.line)
+		if ok != c.ok {
+			t.Fatalf("%q: expected ok=%v, got %v", c.line, c.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		if direction != c.direction {
+			t.Errorf("%q: expected direction %q, got %q", c.line, c.direction, direction)
+		}
+		if content != c.content {
+			t.Errorf("%q: expected content %q, got %q", c.line, c.content, content)
+		}
+	}
+}
+
+func TestLoadTranscript(t *testing.T) {
+	transcript := strings.Join([]string{
+		"> NICK kyle",
+		"< :mockirc.tenyks.io 001 kyle :Welcome",
+		"> PING mockirc.tenyks.io",
+		"< :PONG mockirc.tenyks.io",
+	}, "\n")
+
+	irc := New("mockirc.tenyks.io", 6661)
+	if err := irc.LoadTranscript(strings.NewReader(transcript)); err != nil {
+		t.Fatalf("LoadTranscript returned an error: %v", err)
+	}
+
+	when, ok := irc.events["NICK kyle"]
+	if !ok {
+		t.Fatal("expected an event registered for \"NICK kyle\"")
+	}
+	if len(when.responses) != 1 || when.responses[0] != ":mockirc.tenyks.io 001 kyle :Welcome" {
+		t.Errorf("unexpected responses for \"NICK kyle\": %v", when.responses)
+	}
+
+	when, ok = irc.events["PING mockirc.tenyks.io"]
+	if !ok {
+		t.Fatal("expected an event registered for \"PING mockirc.tenyks.io\"")
+	}
+	if len(when.responses) != 1 || when.responses[0] != ":PONG mockirc.tenyks.io" {
+		t.Errorf("unexpected responses for \"PING mockirc.tenyks.io\": %v", when.responses)
+	}
+}